@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClockSkew bounds how far a subscribe request's X-Gweet-Timestamp may
+// drift from the server's clock before its signature is rejected.
+const ClockSkew = 5 * time.Minute
+
+// errUnauthorized is returned by resolvePublishKey and resolveSubscribeKey
+// when a protected topic's request is missing a valid X-Gweet-Signature.
+var errUnauthorized = errors.New("missing or invalid X-Gweet-Signature")
+
+// topicSecrets remembers which topics have been claimed with an
+// X-Gweet-Secret, keyed by hashKey(key) of the plaintext topic key (i.e.
+// before any secret is mixed in). Once a topic is claimed, every later
+// post or subscribe for it must present a valid signature.
+var topicSecrets = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// claimOrGetSecret registers secret for topicID the first time topicID is
+// seen with a non-empty secret, and otherwise returns whichever secret is
+// already on file for it (empty if the topic was never claimed). alreadyClaimed
+// reports whether topicID was claimed before this call, so the caller can
+// tell the claiming request itself apart from later ones.
+func claimOrGetSecret(topicID string, secret string) (current string, alreadyClaimed bool) {
+	topicSecrets.Lock()
+	defer topicSecrets.Unlock()
+
+	if existing, ok := topicSecrets.m[topicID]; ok {
+		return existing, true
+	}
+	if secret != "" {
+		topicSecrets.m[topicID] = secret
+	}
+	return secret, false
+}
+
+// secretFor returns the secret on file for topicID, and whether the topic
+// has been claimed at all.
+func secretFor(topicID string) (string, bool) {
+	topicSecrets.RLock()
+	defer topicSecrets.RUnlock()
+	secret, ok := topicSecrets.m[topicID]
+	return secret, ok
+}
+
+// protectedCacheKeys records which cache keys (the secureKey a claimed
+// topic's messages actually get stored and published under) belong to a
+// claimed topic. It exists because topicSecrets is keyed by a plaintext
+// topic's hash, not by the secureKey Cacher() sees in CacheMessage.key, so
+// a read that isn't scoped to one already-known key - the aggregate
+// /stats/ - has no other way to tell a protected topic's entry apart from
+// an open one.
+var protectedCacheKeys = struct {
+	sync.RWMutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// markProtected records that cacheKey belongs to a claimed topic.
+func markProtected(cacheKey string) {
+	protectedCacheKeys.Lock()
+	protectedCacheKeys.m[cacheKey] = true
+	protectedCacheKeys.Unlock()
+}
+
+// isProtectedCacheKey reports whether cacheKey belongs to a claimed topic.
+func isProtectedCacheKey(cacheKey string) bool {
+	protectedCacheKeys.RLock()
+	defer protectedCacheKeys.RUnlock()
+	return protectedCacheKeys.m[cacheKey]
+}
+
+// sign computes the hex HMAC-SHA256 of data under secret, in the
+// "sha256=<hex>" form gweet expects in X-Gweet-Signature.
+func sign(secret string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSignature reports whether signature, as received in
+// X-Gweet-Signature, matches data under secret.
+func validSignature(secret string, data []byte, signature string) bool {
+	if signature == "" {
+		return false
+	}
+	return hmac.Equal([]byte(sign(secret, data)), []byte(signature))
+}
+
+// secureKey mixes secret into key's hash so a claimed topic is stored
+// under a cache key an attacker can't derive from the plaintext key alone,
+// even if they guess it.
+func secureKey(key string, secret string) string {
+	return hashKey(key + secret)
+}
+
+// resolvePublishKey claims key's secret from the X-Gweet-Secret header the
+// first time it's posted to (that claiming request needs no signature of
+// its own, since the secret it's presenting isn't on file yet to sign
+// against), and, for an already-claimed key, requires X-Gweet-Signature to
+// be a valid HMAC of body under that secret. It returns the cache key the
+// message should be published under and the secret (empty for an unclaimed
+// topic) to stamp onto the message.
+func resolvePublishKey(r *http.Request, key string, body []byte) (cacheKey string, secret string, err error) {
+	topicID := hashKey(key)
+	secret, alreadyClaimed := claimOrGetSecret(topicID, r.Header.Get("X-Gweet-Secret"))
+	if secret == "" {
+		return topicID, "", nil
+	}
+	if alreadyClaimed && !validSignature(secret, body, r.Header.Get("X-Gweet-Signature")) {
+		return "", "", errUnauthorized
+	}
+	cacheKey = secureKey(key, secret)
+	markProtected(cacheKey)
+	return cacheKey, secret, nil
+}
+
+// resolveSubscribeKey requires, for an already-claimed key, a valid
+// X-Gweet-Signature over key+X-Gweet-Timestamp, with the timestamp within
+// ClockSkew of now. Unclaimed keys are open to any subscriber. It returns
+// the cache key the subscription should read from.
+func resolveSubscribeKey(r *http.Request, key string) (string, error) {
+	topicID := hashKey(key)
+	secret, claimed := secretFor(topicID)
+	if !claimed {
+		return topicID, nil
+	}
+
+	timestamp := r.Header.Get("X-Gweet-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errUnauthorized
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > ClockSkew || skew < -ClockSkew {
+		return "", errUnauthorized
+	}
+	if !validSignature(secret, []byte(key+timestamp), r.Header.Get("X-Gweet-Signature")) {
+		return "", errUnauthorized
+	}
+	cacheKey := secureKey(key, secret)
+	markProtected(cacheKey)
+	return cacheKey, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestResolvePublishKeyClaimRequiresNoSignature(t *testing.T) {
+	initTestEnvironment()
+	key := "auth-test-claim"
+	body := []byte("field=value")
+
+	req, _ := http.NewRequest("POST", "/stream/"+key+"/", nil)
+	req.Header.Set("X-Gweet-Secret", "topsecret")
+
+	cacheKey, secret, err := resolvePublishKey(req, key, body)
+	if err != nil {
+		t.Fatalf("claiming POST should not require a signature, got: %v", err)
+	}
+	if secret != "topsecret" {
+		t.Errorf("Expected secret 'topsecret', got %q", secret)
+	}
+	if cacheKey != secureKey(key, "topsecret") {
+		t.Errorf("Expected cache key %q, got %q", secureKey(key, "topsecret"), cacheKey)
+	}
+}
+
+func TestResolvePublishKeySubsequentRequiresSignature(t *testing.T) {
+	initTestEnvironment()
+	key := "auth-test-subsequent"
+	body := []byte("field=value")
+
+	claim, _ := http.NewRequest("POST", "/stream/"+key+"/", nil)
+	claim.Header.Set("X-Gweet-Secret", "topsecret")
+	if _, _, err := resolvePublishKey(claim, key, body); err != nil {
+		t.Fatalf("Failed to claim topic: %v", err)
+	}
+
+	unsigned, _ := http.NewRequest("POST", "/stream/"+key+"/", nil)
+	if _, _, err := resolvePublishKey(unsigned, key, body); err != errUnauthorized {
+		t.Errorf("Expected errUnauthorized for an unsigned post to a claimed topic, got: %v", err)
+	}
+
+	signed, _ := http.NewRequest("POST", "/stream/"+key+"/", nil)
+	signed.Header.Set("X-Gweet-Signature", sign("topsecret", body))
+	cacheKey, secret, err := resolvePublishKey(signed, key, body)
+	if err != nil {
+		t.Fatalf("Expected a validly signed post to succeed, got: %v", err)
+	}
+	if secret != "topsecret" || cacheKey != secureKey(key, "topsecret") {
+		t.Errorf("Expected the already-established secret to be reused, got secret %q cacheKey %q", secret, cacheKey)
+	}
+}
+
+func TestResolveSubscribeKeyRequiresSignature(t *testing.T) {
+	initTestEnvironment()
+	key := "auth-test-subscribe"
+	body := []byte("field=value")
+
+	claim, _ := http.NewRequest("POST", "/stream/"+key+"/", nil)
+	claim.Header.Set("X-Gweet-Secret", "topsecret")
+	if _, _, err := resolvePublishKey(claim, key, body); err != nil {
+		t.Fatalf("Failed to claim topic: %v", err)
+	}
+
+	unsigned, _ := http.NewRequest("GET", "/stream/"+key+"/", nil)
+	if _, err := resolveSubscribeKey(unsigned, key); err != errUnauthorized {
+		t.Errorf("Expected errUnauthorized for an unsigned subscribe to a claimed topic, got: %v", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	expired, _ := http.NewRequest("GET", "/stream/"+key+"/", nil)
+	expired.Header.Set("X-Gweet-Timestamp", strconv.FormatInt(time.Now().Add(-2*ClockSkew).Unix(), 10))
+	expired.Header.Set("X-Gweet-Signature", sign("topsecret", []byte(key+expired.Header.Get("X-Gweet-Timestamp"))))
+	if _, err := resolveSubscribeKey(expired, key); err != errUnauthorized {
+		t.Errorf("Expected errUnauthorized for a stale timestamp, got: %v", err)
+	}
+
+	signed, _ := http.NewRequest("GET", "/stream/"+key+"/", nil)
+	signed.Header.Set("X-Gweet-Timestamp", timestamp)
+	signed.Header.Set("X-Gweet-Signature", sign("topsecret", []byte(key+timestamp)))
+	cacheKey, err := resolveSubscribeKey(signed, key)
+	if err != nil {
+		t.Fatalf("Expected a validly signed subscribe to succeed, got: %v", err)
+	}
+	if cacheKey != secureKey(key, "topsecret") {
+		t.Errorf("Expected cache key %q, got %q", secureKey(key, "topsecret"), cacheKey)
+	}
+}
+
+// TestStreamsPostHandlerClaimsTopicWithoutSignature verifies that the POST
+// that first presents X-Gweet-Secret succeeds without also having to carry a
+// signature over a secret the client couldn't have signed with yet.
+func TestStreamsPostHandlerClaimsTopicWithoutSignature(t *testing.T) {
+	initTestEnvironment()
+
+	req, err := http.NewRequest("POST", "/stream/auth-test-handler-claim/", strings.NewReader("field=value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Gweet-Secret", "topsecret")
+
+	recorder := httptest.NewRecorder()
+	router := mux.NewRouter()
+	router.HandleFunc("/stream/{key}/", StreamsPostHandler).Methods("POST")
+	router.ServeHTTP(recorder, req)
+
+	if status := recorder.Code; status != http.StatusOK {
+		t.Fatalf("claiming POST returned wrong status code: got %v want %v, body: %s", status, http.StatusOK, recorder.Body.String())
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	message, ok := response["message"].(map[string]interface{})
+	if !ok {
+		t.Fatal("message field is not a map")
+	}
+	if message["signature"] == nil || message["signature"] == "" {
+		t.Errorf("Expected the claiming post's message to carry a signature, got %v", message["signature"])
+	}
+}
+
+// TestStreamsWebsocketHandlerSignsPublishedMessagesOnClaimedTopic verifies
+// that a message published over a WebSocket on a claimed topic is signed
+// the same way a signed HTTP POST would be.
+func TestStreamsWebsocketHandlerSignsPublishedMessagesOnClaimedTopic(t *testing.T) {
+	initTestEnvironment()
+
+	key := "auth-test-ws-claim"
+	secret := "topsecret"
+
+	claim, _ := http.NewRequest("POST", "/stream/"+key+"/", nil)
+	claim.Header.Set("X-Gweet-Secret", secret)
+	if _, _, err := resolvePublishKey(claim, key, nil); err != nil {
+		t.Fatalf("Failed to claim topic: %v", err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/ws/stream/{key}/", StreamsWebsocketHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header := http.Header{}
+	header.Set("X-Gweet-Timestamp", timestamp)
+	header.Set("X-Gweet-Signature", sign(secret, []byte(key+timestamp)))
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/stream/" + key + "/"
+	dialer := &websocket.Dialer{Subprotocols: []string{"gweet.v1"}}
+	conn, _, err := dialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("Failed to dial websocket: %v", err)
+	}
+	defer conn.Close()
+
+	payload := `{"values": {"ws_field": "ws_value"}}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(payload)); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read message back: %v", err)
+	}
+
+	var message map[string]interface{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		t.Fatalf("Failed to parse message JSON: %v, data: %s", err, data)
+	}
+	if message["signature"] == nil || message["signature"] == "" {
+		t.Errorf("Expected the published message to carry a signature, got %v", message["signature"])
+	}
+}
@@ -1,54 +1,309 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
 	"time"
 
-	"github.com/pmylund/go-cache"
+	"github.com/tidwall/wal"
 )
 
-// A cache message.
+// A cache message. operation selects what Cacher() does with it: 0 reads a
+// topic's messages, 1 writes one, 2 reads a single topic's TopicStats, and 3
+// reads a []TopicStats for every topic Cacher() knows about (key is
+// ignored). result is only meaningful for writes: if non-nil, Cacher()
+// sends it the error (if any, e.g. ErrBufferFull) from publishing the
+// message to subscribers.
 type CacheMessage struct {
-	operation int // 0 for read, anything else for write.
+	operation int
 	data      interface{}
 	key       string
+	result    chan error
 }
 
 var CacheBus = make(chan CacheMessage, 100)
 
+// ErrLogUnavailable is sent on a write's result channel when Cacher()
+// couldn't get the message durably stored at all (its log wouldn't open, or
+// a read/marshal/write against it failed), so the publisher gets told the
+// write didn't happen instead of hanging on a reply that would never come.
+var ErrLogUnavailable = errors.New("topic log unavailable")
+
+// DataDir is where each topic's write-ahead log lives, one subdirectory per
+// hashed key. It's set from the -data-dir flag before Cacher() starts.
+var DataDir = "gweet-data"
+
+// openLog opens (or creates) the write-ahead log for a topic key.
+func openLog(key string) (*wal.Log, error) {
+	return wal.Open(filepath.Join(DataDir, key), wal.DefaultOptions)
+}
+
+// readMessages loads every entry currently in a topic's log, oldest first.
+func readMessages(log *wal.Log) ([]interface{}, error) {
+	first, err := log.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+	last, err := log.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]interface{}, 0, last-first+1)
+	for index := first; index <= last && index != 0; index++ {
+		data, err := log.Read(index)
+		if err != nil {
+			return nil, err
+		}
+		var message interface{}
+		if err := json.Unmarshal(data, &message); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// trim drops entries that are older than ItemLifetime or that push the log
+// past MaxQueueLength, keeping the log bounded both by age and by count.
+func trim(log *wal.Log) error {
+	first, err := log.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := log.LastIndex()
+	if err != nil {
+		return err
+	}
+
+	keepFrom := first
+	if count := last - first + 1; count > MaxQueueLength {
+		keepFrom = last - MaxQueueLength + 1
+	}
+
+	cutoff := time.Now().Add(-ItemLifetime)
+	for index := keepFrom; index <= last; index++ {
+		data, err := log.Read(index)
+		if err != nil {
+			return err
+		}
+		var message map[string]interface{}
+		if err := json.Unmarshal(data, &message); err != nil {
+			break
+		}
+		created, err := time.Parse(time.RFC3339Nano, stringField(message["created"]))
+		if err != nil || created.After(cutoff) {
+			break
+		}
+		keepFrom = index + 1
+	}
+
+	if keepFrom > first {
+		return log.TruncateFront(keepFrom)
+	}
+	return nil
+}
+
+// stringField extracts a string field from a decoded message, returning "" if
+// it isn't one.
+func stringField(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// TopicStats is a point-in-time snapshot of one topic's activity, as served
+// by StatsHandler and StatsKeyHandler.
+type TopicStats struct {
+	Key               string `json:"key"`
+	Subscribers       uint64 `json:"subscribers"`
+	MessagesPublished uint64 `json:"messages_published"`
+	MessagesDropped   uint64 `json:"messages_dropped"`
+	BytesStored       uint64 `json:"bytes_stored"`
+	OldestMessage     string `json:"oldest_message,omitempty"`
+	NewestMessage     string `json:"newest_message,omitempty"`
+}
+
+// buildStats assembles a TopicStats for key from its log (published count,
+// bytes currently stored, oldest/newest timestamps) and from TopicMap
+// (subscriber count, messages dropped).
+func buildStats(key string, log *wal.Log) (TopicStats, error) {
+	messages, err := readMessages(log)
+	if err != nil {
+		return TopicStats{}, err
+	}
+	published, err := log.LastIndex()
+	if err != nil {
+		return TopicStats{}, err
+	}
+
+	stats := TopicStats{Key: key, MessagesPublished: published}
+	for i, item := range messages {
+		data, err := json.Marshal(item)
+		if err != nil {
+			continue
+		}
+		stats.BytesStored += uint64(len(data))
+
+		message, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if i == 0 {
+			stats.OldestMessage = stringField(message["created"])
+		}
+		if i == len(messages)-1 {
+			stats.NewestMessage = stringField(message["created"])
+		}
+	}
+
+	stats.Subscribers, stats.MessagesDropped = TopicMap.Stats(key)
+	return stats, nil
+}
+
 func Cacher() {
-	// A cache manager that communicates reads and
-	// writes through a channel, so they are atomic.
-	var messages []interface{}
-	c := cache.New(ItemLifetime, 5*time.Minute)
+	// A cache manager that communicates reads and writes through a channel,
+	// so they are atomic. Messages are durably stored in a per-key
+	// write-ahead log instead of an in-memory cache, so subscribers can
+	// resume from a since=<id> cursor after a restart instead of losing
+	// everything that was queued.
+	logs := make(map[string]*wal.Log)
+
+	getLog := func(key string) *wal.Log {
+		if log, ok := logs[key]; ok {
+			return log
+		}
+		log, err := openLog(key)
+		if err != nil {
+			ERROR.Println("Failed to open log for " + key + ": " + err.Error())
+			return nil
+		}
+		logs[key] = log
+		return log
+	}
 
 	for busMessage := range CacheBus {
-		value, found := c.Get(busMessage.key)
-		if !found {
-			messages = make([]interface{}, 0)
-		} else {
-			messages = value.([]interface{})
+		// Stats for every known topic is the one operation that isn't
+		// scoped to a single key, so handle it before looking up a log.
+		if busMessage.operation == 3 {
+			all := make([]TopicStats, 0, len(logs))
+			for key, log := range logs {
+				// A claimed topic's activity is only for holders of its
+				// secret to see; the aggregate endpoint has no secret to
+				// check a signature against, so it omits them entirely
+				// rather than leaking them to anyone who asks.
+				if isProtectedCacheKey(key) {
+					continue
+				}
+				stats, err := buildStats(key, log)
+				if err != nil {
+					ERROR.Println("Failed to build stats for " + key + ": " + err.Error())
+					continue
+				}
+				all = append(all, stats)
+			}
+			busMessage.data.(chan []TopicStats) <- all
+			continue
 		}
 
-		if busMessage.operation == 0 {
-			// Read from the cache.
-			busMessage.data.(chan []interface{}) <- messages
-		} else {
-			// Write to the cache.
-			messages = append(messages, busMessage.data)
+		log := getLog(busMessage.key)
+		if log == nil {
+			switch busMessage.operation {
+			case 0:
+				busMessage.data.(chan []interface{}) <- nil
+			case 2:
+				busMessage.data.(chan TopicStats) <- TopicStats{Key: busMessage.key}
+			default:
+				if busMessage.result != nil {
+					busMessage.result <- ErrLogUnavailable
+				}
+			}
+			continue
+		}
 
-			// Truncate the queue if it's too long.
-			if len(messages) > MaxQueueLength {
-				messages = messages[1:len(messages)]
+		switch busMessage.operation {
+		case 0:
+			// Read from the log.
+			messages, err := readMessages(log)
+			if err != nil {
+				ERROR.Println("Failed to read log for " + busMessage.key + ": " + err.Error())
+			}
+			busMessage.data.(chan []interface{}) <- messages
+		case 2:
+			// Stats for a single topic.
+			stats, err := buildStats(busMessage.key, log)
+			if err != nil {
+				ERROR.Println("Failed to build stats for " + busMessage.key + ": " + err.Error())
+				stats = TopicStats{Key: busMessage.key}
+			}
+			busMessage.data.(chan TopicStats) <- stats
+		default:
+			// Assign the message a monotonically increasing ID, scoped to
+			// its key and backed by the log's own index, before it's
+			// stored or broadcast. id and seq are the same value: id is
+			// the cursor clients pass back in since=<id>, seq names that
+			// same number for clients that care about its log-sequence
+			// meaning.
+			last, err := log.LastIndex()
+			if err != nil {
+				ERROR.Println("Failed to read last index for " + busMessage.key + ": " + err.Error())
+				if busMessage.result != nil {
+					busMessage.result <- ErrLogUnavailable
+				}
+				continue
+			}
+			id := last + 1
+			if message, ok := busMessage.data.(map[string]interface{}); ok {
+				message["id"] = id
+				message["seq"] = id
 			}
 
-			c.Set(busMessage.key, messages, 0)
+			data, err := json.Marshal(busMessage.data)
+			if err != nil {
+				ERROR.Println("Failed to marshal message for " + busMessage.key + ": " + err.Error())
+				if busMessage.result != nil {
+					busMessage.result <- ErrLogUnavailable
+				}
+				continue
+			}
+			if err := log.Write(id, data); err != nil {
+				ERROR.Println("Failed to write log for " + busMessage.key + ": " + err.Error())
+				if busMessage.result != nil {
+					busMessage.result <- ErrLogUnavailable
+				}
+				continue
+			}
+			if err := trim(log); err != nil {
+				ERROR.Println("Failed to trim log for " + busMessage.key + ": " + err.Error())
+			}
 
-			// Broadcast the message to streamers.
+			// Broadcast the message to streamers in its own goroutine,
+			// rather than inline here: Publish can take up to BlockTimeout
+			// to return for a PolicyBlock subscriber who's stopped reading,
+			// and running that synchronously in Cacher()'s single shared
+			// loop would stall every other topic's reads and writes behind
+			// it. broker.publishMu keeps this topic's own deliveries in
+			// publish order even though they now run concurrently with
+			// each other.
 			TopicMap.RLock()
-			if currentTopic, ok := TopicMap.m[busMessage.key]; ok {
-				currentTopic.t.Broadcast <- busMessage.data
-			}
+			broker, ok := TopicMap.m[busMessage.key]
 			TopicMap.RUnlock()
+
+			if !ok {
+				if busMessage.result != nil {
+					busMessage.result <- nil
+				}
+				continue
+			}
+
+			go func(broker *Broker, message interface{}, result chan error) {
+				broker.publishMu.Lock()
+				err := broker.Publish(message)
+				broker.publishMu.Unlock()
+				if result != nil {
+					result <- err
+				}
+			}(broker, busMessage.data, busMessage.result)
 		}
 	}
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestPublishReturnsErrorWhenLogUnavailable verifies that a write whose log
+// can't be opened fails fast with ErrLogUnavailable instead of leaving
+// publish() (and so the HTTP handler calling it) blocked forever on a
+// result that Cacher() would otherwise never send.
+func TestPublishReturnsErrorWhenLogUnavailable(t *testing.T) {
+	initTestEnvironment()
+
+	// A regular file can't be MkdirAll'd into, so opening any topic's WAL
+	// under it fails every time.
+	blocker, err := os.CreateTemp("", "gweet-test-not-a-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker.Close()
+	defer os.Remove(blocker.Name())
+
+	previous := DataDir
+	DataDir = blocker.Name()
+	defer func() { DataDir = previous }()
+
+	message := makeMessage("unavailable-log-test", &url.Values{}, "")
+
+	done := make(chan error, 1)
+	go func() { done <- publish(message, "unavailable-log-test-key") }()
+
+	select {
+	case err := <-done:
+		if err != ErrLogUnavailable {
+			t.Errorf("Expected ErrLogUnavailable, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("publish() hung instead of reporting the log was unavailable")
+	}
+}
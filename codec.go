@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// PayloadCodec serializes a single message for the wire. Selected per
+// request from the Accept header, so clients that would rather not pay the
+// JSON-parsing tax (e.g. embedded consumers) can ask for msgpack instead.
+type PayloadCodec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	// Keepalive returns the bytes for a keepalive frame in this codec.
+	Keepalive() []byte
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+// Marshal appends a trailing newline, so messages read like the
+// newline-delimited JSON stream this endpoint has always produced.
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+func (jsonCodec) Keepalive() []byte { return []byte("\n") }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string                   { return "application/msgpack" }
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+func (msgpackCodec) Keepalive() []byte {
+	b, _ := msgpack.Marshal(map[string]interface{}{})
+	return b
+}
+
+// codecFor picks a PayloadCodec based on the Accept header, defaulting to
+// JSON for backwards compatibility with every existing client.
+func codecFor(r *http.Request) PayloadCodec {
+	if strings.Contains(r.Header.Get("Accept"), "application/msgpack") {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
+
+// flushWriteCloser is what every compress/* and brotli writer already
+// implements: buffered writes that can be forced onto the wire with Flush,
+// and terminated with Close.
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressionCodec wraps a response body in a particular content encoding.
+type compressionCodec struct {
+	name      string
+	newWriter func(io.Writer) flushWriteCloser
+}
+
+// compressionCodecs is checked in order, so it also doubles as a preference
+// list when a client advertises support for more than one.
+var compressionCodecs = []compressionCodec{
+	{"br", func(w io.Writer) flushWriteCloser { return brotli.NewWriter(w) }},
+	{"gzip", func(w io.Writer) flushWriteCloser { return gzip.NewWriter(w) }},
+	{"deflate", func(w io.Writer) flushWriteCloser {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	}},
+}
+
+// compressorFor picks a compressionCodec based on Accept-Encoding, or nil if
+// the client didn't advertise support for any of them.
+func compressorFor(r *http.Request) *compressionCodec {
+	acceptEncoding := r.Header.Get("Accept-Encoding")
+	for i := range compressionCodecs {
+		if strings.Contains(acceptEncoding, compressionCodecs[i].name) {
+			return &compressionCodecs[i]
+		}
+	}
+	return nil
+}
+
+// MessageEncoder owns framing and compression for the chunked streaming
+// transport: it marshals each message with a PayloadCodec, optionally runs
+// the result through a compressionCodec, and always emits exactly one HTTP
+// chunk per logical write.
+type MessageEncoder struct {
+	codec PayloadCodec
+	comp  *compressionCodec
+
+	chunk  *chunkWriter
+	writer flushWriteCloser // only set when comp != nil
+}
+
+// newMessageEncoder builds a MessageEncoder for the given request, writing
+// framed chunks to bufrw.
+func newMessageEncoder(r *http.Request, bufrw *bufio.ReadWriter) *MessageEncoder {
+	enc := &MessageEncoder{codec: codecFor(r), comp: compressorFor(r), chunk: &chunkWriter{bufrw: bufrw}}
+	if enc.comp != nil {
+		enc.writer = enc.comp.newWriter(enc.chunk)
+	}
+	return enc
+}
+
+// ContentType is the Content-Type header value for this encoder's payload
+// codec.
+func (e *MessageEncoder) ContentType() string {
+	return e.codec.ContentType()
+}
+
+// ContentEncoding is the Content-Encoding header value for this encoder's
+// compression codec, or "" if none was negotiated.
+func (e *MessageEncoder) ContentEncoding() string {
+	if e.comp == nil {
+		return ""
+	}
+	return e.comp.name
+}
+
+// write frames body as a single HTTP chunk, going through the compressor
+// (and flushing it) when one is active.
+func (e *MessageEncoder) write(body []byte) error {
+	if e.writer == nil {
+		if _, err := e.chunk.bufrw.Write(Chunk(string(body))); err != nil {
+			return err
+		}
+		return e.chunk.bufrw.Flush()
+	}
+
+	if _, err := e.writer.Write(body); err != nil {
+		return err
+	}
+	if err := e.writer.Flush(); err != nil {
+		return err
+	}
+	return e.chunk.Flush()
+}
+
+// WriteMessage marshals v with this encoder's payload codec and sends it as
+// one chunk.
+func (e *MessageEncoder) WriteMessage(v interface{}) error {
+	body, err := e.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return e.write(body)
+}
+
+// Keepalive sends a codec-aware keepalive frame.
+func (e *MessageEncoder) Keepalive() error {
+	return e.write(e.codec.Keepalive())
+}
+
+// Close releases the compressor, if any.
+func (e *MessageEncoder) Close() error {
+	if e.writer == nil {
+		return nil
+	}
+	return e.writer.Close()
+}
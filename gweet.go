@@ -19,7 +19,11 @@ func main() {
 	var debug_enabled = flag.Bool("debug", false, "Enable debug logging")
 	var intf = flag.String("interface", "0.0.0.0", "The interface to listen on")
 	var port = flag.Int("port", 9835, "The port to listen on")
+	var dataDir = flag.String("data-dir", "gweet-data", "Where to store each topic's write-ahead log")
+	var bufferLength = flag.Int("buffer-length", BufferLength, "How many messages to buffer per subscriber before its eviction policy kicks in")
 	flag.Parse()
+	DataDir = *dataDir
+	BufferLength = *bufferLength
 	if *debug_enabled {
 		InitLogging(os.Stdout, os.Stdout, os.Stdout, os.Stderr)
 	} else {
@@ -28,9 +32,16 @@ func main() {
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", HomeHandler)
+	r.HandleFunc("/stream/{key}/", StreamsStreamingGetHandler).Methods("GET").Headers("Accept", "text/event-stream")
+	r.HandleFunc("/stream/{key}/", StreamsStreamingGetHandler).Methods("GET").Queries("sse", "1")
 	r.HandleFunc("/stream/{key}/", StreamsStreamingGetHandler).Methods("GET").Queries("streaming", "1")
+	r.HandleFunc("/stream/{key}/sse", StreamsSSEGetHandler).Methods("GET")
 	r.HandleFunc("/stream/{key}/", StreamsGetHandler).Methods("GET")
 	r.HandleFunc("/stream/{key}/", StreamsPostHandler).Methods("POST")
+	r.HandleFunc("/ws/stream/{key}/", StreamsWebsocketHandler)
+	r.HandleFunc("/stream/{key}/ws", StreamsWebsocketHandler)
+	r.HandleFunc("/stats/", StatsHandler).Methods("GET")
+	r.HandleFunc("/stats/{key}/", StatsKeyHandler).Methods("GET")
 
 	go Cacher()
 	INFO.Println("Listening on " + *intf + ":" + strconv.Itoa(*port))
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -15,11 +19,18 @@ import (
 
 var c = cache.New(ItemLifetime, 5*time.Minute)
 
-func makeMessage(key string, values *url.Values) interface{} {
+// makeMessage builds the message gweet stores and broadcasts for a post to
+// key. If secret is non-empty, the topic is HMAC-protected and the message
+// is stamped with a signature subscribers can use to verify it came from a
+// holder of that secret.
+func makeMessage(key string, values *url.Values, secret string) interface{} {
 	message := make(map[string]interface{})
 	message["name"] = key
 	message["values"] = values
 	message["created"] = time.Now().Format(time.RFC3339Nano)
+	if secret != "" {
+		message["signature"] = sign(secret, []byte(JSONToString(message)))
+	}
 	return message
 }
 
@@ -35,7 +46,153 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "This is a <a href='https://github.com/skorokithakis/gweet/'>Gweet server</a>. Please read the documentation on how to talk to it.")
 }
 
+// wantsSSE reports whether the client asked for Server-Sent Events, either
+// via the Accept header or the ?sse=1 query parameter.
+func wantsSSE(r *http.Request) bool {
+	if r.URL.Query().Get("sse") == "1" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// policyFor returns the eviction policy a new subscriber registers with,
+// selected via ?policy=block|drop-oldest|disconnect. It defaults to
+// PolicyDropOldest, gweet's existing drop-the-oldest behavior.
+func policyFor(r *http.Request) EvictionPolicy {
+	switch policy := EvictionPolicy(r.URL.Query().Get("policy")); policy {
+	case PolicyBlock, PolicyDisconnect:
+		return policy
+	default:
+		return PolicyDropOldest
+	}
+}
+
+// writeJSONResponse marshals response with the payload codec the request's
+// Accept header selects (JSON by default, msgpack on request) and, if the
+// client advertised support for one, compresses it. Compressed responses
+// drop Content-Length since it isn't known up front.
+func writeJSONResponse(w http.ResponseWriter, r *http.Request, response JSONResponse) {
+	codec := codecFor(r)
+	w.Header().Set("Content-Type", codec.ContentType())
+
+	body, err := codec.Marshal(map[string]interface{}(response))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	comp := compressorFor(r)
+	if comp == nil {
+		w.Write(body)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", comp.name)
+	w.Header().Set("Vary", "Accept-Encoding")
+	cw := comp.newWriter(w)
+	defer cw.Close()
+	cw.Write(body)
+}
+
+// messageID extracts the per-key monotonic ID that Cacher() stamps onto
+// each message, returning 0 if the message predates that field.
+func messageID(message map[string]interface{}) uint64 {
+	switch id := message["id"].(type) {
+	case uint64:
+		return id
+	case float64:
+		return uint64(id)
+	default:
+		return 0
+	}
+}
+
+// writeSSEMessage writes a single message as a `text/event-stream` frame
+// and flushes it immediately. It returns false if the write failed, which
+// means the client went away.
+func writeSSEMessage(w http.ResponseWriter, flusher http.Flusher, message map[string]interface{}) bool {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", messageID(message), JSONToString(message))
+	if err != nil {
+		return false
+	}
+	flusher.Flush()
+	return true
+}
+
+// StreamsSSEGetHandler serves the streaming endpoint as standards-compliant
+// Server-Sent Events, so any browser EventSource can consume it without a
+// custom client. It honors Last-Event-ID by replaying any cached messages
+// with a higher ID before joining the live subscription.
+func StreamsSSEGetHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Webserver doesn't support flushing.", http.StatusInternalServerError)
+		return
+	}
+
+	key, err := resolveSubscribeKey(r, mux.Vars(r)["key"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	messageBus := TopicMap.Register(key, policyFor(r))
+	defer TopicMap.Unregister(key, messageBus)
+
+	since, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	if since > 0 {
+		backchan := make(chan []interface{}, 1)
+		CacheBus <- CacheMessage{0, backchan, key, nil}
+		for _, cached := range <-backchan {
+			message, ok := cached.(map[string]interface{})
+			if !ok || messageID(message) <= since {
+				continue
+			}
+			if !writeSSEMessage(w, flusher, message) {
+				return
+			}
+		}
+	}
+
+	ticker := time.Tick(30 * time.Second)
+	for {
+		select {
+		case message, ok := <-messageBus:
+			if !ok {
+				return
+			}
+			if !writeSSEMessage(w, flusher, message.(map[string]interface{})) {
+				return
+			}
+		case <-ticker:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
 func StreamsStreamingGetHandler(w http.ResponseWriter, r *http.Request) {
+	if wantsSSE(r) {
+		StreamsSSEGetHandler(w, r)
+		return
+	}
+
+	key, err := resolveSubscribeKey(r, mux.Vars(r)["key"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Webserver doesn't support hijacking.", http.StatusInternalServerError)
@@ -51,15 +208,38 @@ func StreamsStreamingGetHandler(w http.ResponseWriter, r *http.Request) {
 	defer conn.Close()
 	defer conn.Write(Chunk(""))
 
+	// encoder owns both the payload format (JSON/msgpack, from Accept) and
+	// the content encoding (gzip/brotli/deflate, from Accept-Encoding), and
+	// frames every message or keepalive it's given as exactly one chunk.
+	encoder := newMessageEncoder(r, bufrw)
+	defer encoder.Close()
+
 	fmt.Fprintf(bufrw, "HTTP/1.1 200 OK\r\n")
 	fmt.Fprintf(bufrw, "Transfer-Encoding: chunked\r\n")
-	fmt.Fprintf(bufrw, "Content-Type: application/json\r\n\r\n")
+	fmt.Fprintf(bufrw, "Content-Type: %s\r\n", encoder.ContentType())
+	if contentEncoding := encoder.ContentEncoding(); contentEncoding != "" {
+		fmt.Fprintf(bufrw, "Content-Encoding: %s\r\n", contentEncoding)
+	}
+	fmt.Fprintf(bufrw, "\r\n")
 	bufrw.Flush()
 
-	key := hashKey(mux.Vars(r)["key"])
-	messageBus := TopicMap.Register(key)
+	messageBus := TopicMap.Register(key, policyFor(r))
 	defer TopicMap.Unregister(key, messageBus)
 
+	// Replay anything newer than ?since=<id> from the log before switching
+	// to live tailing, so a reconnecting client doesn't lose messages that
+	// arrived while it was disconnected.
+	if since, err := strconv.ParseUint(r.FormValue("since"), 10, 64); err == nil {
+		backchan := make(chan []interface{}, 1)
+		CacheBus <- CacheMessage{0, backchan, key, nil}
+		replay, _ := messagesSince(<-backchan, since)
+		for _, item := range replay {
+			if err := encoder.WriteMessage(item); err != nil {
+				return
+			}
+		}
+	}
+
 	// Keepalive ticker
 	ticker := time.Tick(30 * time.Second)
 	for {
@@ -69,17 +249,9 @@ func StreamsStreamingGetHandler(w http.ResponseWriter, r *http.Request) {
 			if !ok {
 				return
 			}
-			assertedMessage := message.(map[string]interface{})
-			_, err = bufrw.Write(Chunk(JSONToString(assertedMessage) + "\n"))
-			if err == nil {
-				err = bufrw.Flush()
-			}
+			err = encoder.WriteMessage(message.(map[string]interface{}))
 		case _ = <-ticker:
-			// Send the keepalive.
-			_, err = bufrw.Write(Chunk("\n"))
-			if err == nil {
-				err = bufrw.Flush()
-			}
+			err = encoder.Keepalive()
 		}
 
 		// An error means the connection was closed, return.
@@ -89,10 +261,40 @@ func StreamsStreamingGetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// chunkWriter buffers writes and only frames them as an HTTP chunk when
+// Flush is called, so a compressionCodec's writer can sit on top of it and
+// have its header, compressed data, and flush marker collapse into a single
+// chunk on the wire rather than several.
+type chunkWriter struct {
+	bufrw *bufio.ReadWriter
+	buf   bytes.Buffer
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	return cw.buf.Write(p)
+}
+
+func (cw *chunkWriter) Flush() error {
+	if _, err := cw.bufrw.Write(Chunk(cw.buf.String())); err != nil {
+		return err
+	}
+	cw.buf.Reset()
+	return cw.bufrw.Flush()
+}
+
 func StreamsGetHandler(w http.ResponseWriter, r *http.Request) {
-	// All keys are stored hash so we can easily retrieve them for the Push
+	// All keys are stored hashed so we can easily retrieve them for the Push
 	// handler, and to save space.
-	key := hashKey(mux.Vars(r)["key"])
+	key, err := resolveSubscribeKey(r, mux.Vars(r)["key"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if sinceParam := r.FormValue("since"); sinceParam != "" {
+		streamsLongPollGetHandler(w, r, key, sinceParam)
+		return
+	}
 
 	latest, err := strconv.Atoi(r.FormValue("latest"))
 	if err != nil || latest <= 0 || latest >= MaxQueueLength {
@@ -101,24 +303,132 @@ func StreamsGetHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get the messages from the cache.
 	backchan := make(chan []interface{}, 1)
-	CacheBus <- CacheMessage{0, backchan, key}
+	CacheBus <- CacheMessage{0, backchan, key, nil}
 	messages := <-backchan
 
 	w.Header().Set("Content-Type", "application/json")
 	lowerBound := int(math.Max(0, float64(len(messages)-latest)))
 	upperBound := len(messages)
-	fmt.Fprint(w, JSONResponse{"messages": messages[lowerBound:upperBound]})
+	writeJSONResponse(w, r, JSONResponse{"messages": messages[lowerBound:upperBound]})
+}
+
+// messagesSince splits cached into the messages with an ID greater than
+// since and the cursor the caller should pass as since on its next call.
+func messagesSince(cached []interface{}, since uint64) ([]interface{}, uint64) {
+	messages := make([]interface{}, 0)
+	cursor := since
+	for _, item := range cached {
+		message, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if id := messageID(message); id > since {
+			messages = append(messages, item)
+			if id > cursor {
+				cursor = id
+			}
+		}
+	}
+	return messages, cursor
+}
+
+// streamsLongPollGetHandler serves the ?since=<id>&wait=<seconds> mode: it
+// returns immediately with any cached messages newer than since, or, if
+// none exist and wait is positive, blocks for up to wait seconds for the
+// first new message (plus anything else that arrives in the same tick).
+// This gives clients on networks that break chunked responses a working
+// alternative to ?streaming=1 without holding a persistent socket open.
+func streamsLongPollGetHandler(w http.ResponseWriter, r *http.Request, key string, sinceParam string) {
+	since, err := strconv.ParseUint(sinceParam, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid since parameter.", http.StatusBadRequest)
+		return
+	}
+
+	wait, err := strconv.Atoi(r.FormValue("wait"))
+	if err != nil || wait < 0 {
+		wait = 0
+	}
+
+	backchan := make(chan []interface{}, 1)
+	CacheBus <- CacheMessage{0, backchan, key, nil}
+	messages, cursor := messagesSince(<-backchan, since)
+
+	if len(messages) == 0 && wait > 0 {
+		messageBus := TopicMap.Register(key, policyFor(r))
+		defer TopicMap.Unregister(key, messageBus)
+
+		select {
+		case message, ok := <-messageBus:
+			if ok {
+				messages = append(messages, message)
+				if asserted, ok := message.(map[string]interface{}); ok {
+					cursor = messageID(asserted)
+				}
+			}
+		case <-time.After(time.Duration(wait) * time.Second):
+		}
+
+		// Drain any further messages that arrived in the same tick, so the
+		// caller doesn't have to round-trip once per message.
+		for drained := false; !drained; {
+			select {
+			case message, ok := <-messageBus:
+				if !ok {
+					drained = true
+					break
+				}
+				messages = append(messages, message)
+				if asserted, ok := message.(map[string]interface{}); ok {
+					cursor = messageID(asserted)
+				}
+			default:
+				drained = true
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writeJSONResponse(w, r, JSONResponse{"messages": messages, "next_cursor": cursor})
+}
+
+// publish writes message to the cache and waits to hear whether it reached
+// every subscriber. It reports ErrBufferFull back to the caller so a
+// publisher can be told "slow down" instead of having the message silently
+// dropped on the floor.
+func publish(message interface{}, key string) error {
+	result := make(chan error, 1)
+	CacheBus <- CacheMessage{1, message, key, result}
+	return <-result
 }
 
 func StreamsPostHandler(w http.ResponseWriter, r *http.Request) {
 	key := mux.Vars(r)["key"]
 
-	r.ParseForm()
-	message := makeMessage(key, &r.Form)
-	key = hashKey(key)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cacheKey, secret, err := resolvePublishKey(r, key, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
-	// Write the message to the cache.
-	CacheBus <- CacheMessage{1, message, key}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	message := makeMessage(key, &form, secret)
+
+	if err := publish(message, cacheKey); err != nil {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprint(w, JSONResponse{"status": "success", "message": message})
@@ -129,10 +439,13 @@ func PushHandler(w http.ResponseWriter, r *http.Request) {
 	key := mux.Vars(r)["key"]
 
 	r.ParseForm()
-	message := makeMessage(key, &r.Form)
+	message := makeMessage(key, &r.Form, "")
 
-	// Write the message to the cache.
-	CacheBus <- CacheMessage{1, message, key}
+	if err := publish(message, key); err != nil {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprint(w, JSONResponse{"status": "success", "message": message})
@@ -7,8 +7,6 @@ import (
 	"log"
 	"net/http"
 	"time"
-
-	"github.com/pmylund/go-cache"
 )
 
 type JSONResponse map[string]interface{}
@@ -63,45 +61,15 @@ func Log(handler http.Handler) http.Handler {
 }
 
 // A chunked response helper.
-func Chunk(s string) string {
-	return fmt.Sprintf("%x\r\n%v\r\n", len(s), s)
-}
-
-// A cache message.
-type CacheMessage struct {
-	operation int // 0 for read, anything else for write.
-	data      interface{}
-	key       string
+func Chunk(s string) []byte {
+	return []byte(fmt.Sprintf("%x\r\n%v\r\n", len(s), s))
 }
 
-var CacheBus = make(chan CacheMessage, 100)
-
-func Cacher() {
-	// A cache manager that communicates reads and
-	// writes through a channel, so they are atomic.
-	var messages []interface{}
-	c := cache.New(ItemLifetime, 5*time.Minute)
-
-	for busMessage := range CacheBus {
-		value, found := c.Get(busMessage.key)
-		if !found {
-			messages = make([]interface{}, 0)
-		} else {
-			messages = value.([]interface{})
-		}
-
-		if busMessage.operation == 0 {
-			// Read from the cache.
-			busMessage.data.(chan []interface{}) <- messages
-		} else {
-			// Write to the cache.
-			messages = append(messages, busMessage.data)
-
-			// Truncate the queue if it's too long.
-			if len(messages) > MaxQueueLength {
-				messages = messages[1:len(messages)]
-			}
-			c.Set(busMessage.key, messages, 0)
-		}
+// JSONToString marshals a message for the streaming wire format.
+func JSONToString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
 	}
+	return string(b)
 }
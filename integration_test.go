@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -23,11 +24,10 @@ func TestHighLoadIntegration(t *testing.T) {
 	testKey := "test-high-load-integration"
 
 	// Reset the TopicMap to ensure clean state.
-	TopicMap = TopicMapStruct{m: make(map[string]*TopicMapEntry)}
+	TopicMap = TopicMapStruct{m: make(map[string]*Broker)}
 
 	// Tracking variables.
 	var totalSent int64
-	var totalDropped int64
 	var readersDropped int64
 	readerStats := make([]int64, numReaders)
 	readerActive := make([]bool, numReaders)
@@ -39,7 +39,7 @@ func TestHighLoadIntegration(t *testing.T) {
 	// Register readers and mark them as active.
 	readerChannels := make([]chan interface{}, numReaders)
 	for i := 0; i < numReaders; i++ {
-		readerChannels[i] = TopicMap.Register(testKey)
+		readerChannels[i] = TopicMap.Register(testKey, PolicyDropOldest)
 		readerActive[i] = true
 		defer func(idx int, ch chan interface{}) {
 			if readerActive[idx] {
@@ -142,26 +142,19 @@ func TestHighLoadIntegration(t *testing.T) {
 					messageNum := writerID*messagesPerWriter + burst*burstSize + j
 					message := fmt.Sprintf("msg-%d-w%d", messageNum, writerID)
 
-					// Try to broadcast the message.
+					// Try to publish the message.
 					TopicMap.RLock()
-					if currentTopic, ok := TopicMap.m[testKey]; ok {
-						select {
-						case currentTopic.t.Broadcast <- message:
-							atomic.AddInt64(&totalSent, 1)
-							if j == 0 {
-								t.Logf("Writer %d: sent first message", writerID)
-							}
-						default:
-							// Broadcast channel is full.
-							atomic.AddInt64(&totalDropped, 1)
-							t.Logf("Writer %d: broadcast channel full at message %d", writerID, j)
-							// Back off a bit when channel is full.
-							time.Sleep(1 * time.Millisecond)
+					broker, ok := TopicMap.m[testKey]
+					TopicMap.RUnlock()
+					if ok {
+						broker.Publish(message)
+						atomic.AddInt64(&totalSent, 1)
+						if j == 0 {
+							t.Logf("Writer %d: sent first message", writerID)
 						}
 					} else {
 						t.Logf("Writer %d: topic not found", writerID)
 					}
-					TopicMap.RUnlock()
 				}
 
 				// Send remainder messages if any.
@@ -171,15 +164,12 @@ func TestHighLoadIntegration(t *testing.T) {
 						message := fmt.Sprintf("msg-%d-w%d", messageNum, writerID)
 
 						TopicMap.RLock()
-						if currentTopic, ok := TopicMap.m[testKey]; ok {
-							select {
-							case currentTopic.t.Broadcast <- message:
-								atomic.AddInt64(&totalSent, 1)
-							default:
-								atomic.AddInt64(&totalDropped, 1)
-							}
-						}
+						broker, ok := TopicMap.m[testKey]
 						TopicMap.RUnlock()
+						if ok {
+							broker.Publish(message)
+							atomic.AddInt64(&totalSent, 1)
+						}
 					}
 				}
 
@@ -227,14 +217,12 @@ func TestHighLoadIntegration(t *testing.T) {
 
 	// Calculate statistics.
 	totalSentFinal := atomic.LoadInt64(&totalSent)
-	totalDroppedFinal := atomic.LoadInt64(&totalDropped)
 	droppedReaders := atomic.LoadInt64(&readersDropped)
 	actualDuration := time.Since(startTime)
 
 	t.Logf("\n=== High Load Test Statistics ===")
 	t.Logf("Total messages attempted: %d", totalMessages)
 	t.Logf("Total messages sent: %d (%.1f%%)", totalSentFinal, float64(totalSentFinal)*100/float64(totalMessages))
-	t.Logf("Total messages dropped: %d (%.1f%%)", totalDroppedFinal, float64(totalDroppedFinal)*100/float64(totalMessages))
 	t.Logf("Send duration: %v", actualDuration)
 	t.Logf("Actual send rate: %.0f messages/second", float64(totalSentFinal)/actualDuration.Seconds())
 	t.Logf("Readers dropped as slow: %d/%d", droppedReaders, numReaders)
@@ -287,3 +275,58 @@ func TestHighLoadIntegration(t *testing.T) {
 		t.Errorf("Total messages received: %d (expected 90)", totalReceived)
 	}
 }
+
+// TestCacherDoesNotStallOnSlowBlockSubscriber verifies that a topic stalled
+// behind a PolicyBlock subscriber who's stopped reading doesn't block
+// Cacher()'s single shared loop from servicing any other topic's publish.
+func TestCacherDoesNotStallOnSlowBlockSubscriber(t *testing.T) {
+	initTestEnvironment()
+
+	previous := BufferLength
+	BufferLength = 1
+	defer func() { BufferLength = previous }()
+
+	slowKey := "cacher-stall-test-slow"
+	otherKey := "cacher-stall-test-other"
+
+	slowCh := TopicMap.Register(slowKey, PolicyBlock)
+	defer TopicMap.Unregister(slowKey, slowCh)
+
+	// Fill the slow subscriber's one-slot buffer; this publish succeeds
+	// immediately.
+	fill := make(chan error, 1)
+	CacheBus <- CacheMessage{1, makeMessage(slowKey, &url.Values{}, ""), slowKey, fill}
+	if err := <-fill; err != nil {
+		t.Fatalf("Failed to fill the slow subscriber's buffer: %v", err)
+	}
+
+	// Nobody ever reads slowCh again, so this publish will block for up to
+	// BlockTimeout before Cacher() can report ErrBufferFull for it.
+	stall := make(chan error, 1)
+	CacheBus <- CacheMessage{1, makeMessage(slowKey, &url.Values{}, ""), slowKey, stall}
+
+	// Give the stalling publish time to actually start blocking before
+	// racing the unrelated topic's publish against it.
+	time.Sleep(100 * time.Millisecond)
+
+	otherResult := make(chan error, 1)
+	start := time.Now()
+	CacheBus <- CacheMessage{1, makeMessage(otherKey, &url.Values{}, ""), otherKey, otherResult}
+	if err := <-otherResult; err != nil {
+		t.Fatalf("Unrelated topic's publish failed: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Unrelated topic's publish took %v; expected it to return promptly instead of waiting behind the stalled topic", elapsed)
+	}
+
+	select {
+	case err := <-stall:
+		if err != ErrBufferFull {
+			t.Errorf("Expected the stalled publish to eventually report ErrBufferFull, got: %v", err)
+		}
+	case <-time.After(BlockTimeout + time.Second):
+		t.Error("Stalled publish never completed")
+	}
+}
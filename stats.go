@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// StatsHandler returns a snapshot of every topic Cacher() currently knows
+// about, in a single O(topics) scan under one lock acquisition rather than
+// one lookup per topic.
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	backchan := make(chan []TopicStats, 1)
+	CacheBus <- CacheMessage{3, backchan, "", nil}
+	stats := <-backchan
+
+	writeJSONResponse(w, r, JSONResponse{"topics": stats})
+}
+
+// StatsKeyHandler returns the activity snapshot for a single topic. Like
+// every other read path, a claimed topic requires a valid X-Gweet-Signature.
+func StatsKeyHandler(w http.ResponseWriter, r *http.Request) {
+	cacheKey, err := resolveSubscribeKey(r, mux.Vars(r)["key"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	backchan := make(chan TopicStats, 1)
+	CacheBus <- CacheMessage{2, backchan, cacheKey, nil}
+	stats := <-backchan
+
+	writeJSONResponse(w, r, JSONResponse{"topic": stats})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func statsRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/stream/{key}/", StreamsPostHandler).Methods("POST")
+	router.HandleFunc("/stats/", StatsHandler).Methods("GET")
+	router.HandleFunc("/stats/{key}/", StatsKeyHandler).Methods("GET")
+	return router
+}
+
+func postField(router *mux.Router, path string, secret string) *httptest.ResponseRecorder {
+	form := url.Values{}
+	form.Add("field", "value")
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if secret != "" {
+		req.Header.Set("X-Gweet-Secret", secret)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// TestStatsKeyHandlerOpenTopic verifies that an unclaimed topic's stats are
+// readable with no authentication, same as every other unclaimed read path.
+func TestStatsKeyHandlerOpenTopic(t *testing.T) {
+	initTestEnvironment()
+	router := statsRouter()
+
+	if status := postField(router, "/stream/stats-test-open/", "").Code; status != http.StatusOK {
+		t.Fatalf("Expected post to succeed, got status %d", status)
+	}
+
+	req, _ := http.NewRequest("GET", "/stats/stats-test-open/", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	topic, ok := response["topic"].(map[string]interface{})
+	if !ok {
+		t.Fatal("topic field is not a map")
+	}
+	if topic["messages_published"] != float64(1) {
+		t.Errorf("Expected messages_published 1, got %v", topic["messages_published"])
+	}
+}
+
+// TestStatsKeyHandlerRequiresSignatureForClaimedTopic verifies that
+// /stats/{key}/ is gated the same way every other read of a claimed topic
+// is: no signature, no stats.
+func TestStatsKeyHandlerRequiresSignatureForClaimedTopic(t *testing.T) {
+	initTestEnvironment()
+	router := statsRouter()
+
+	key := "stats-test-claimed"
+	secret := "topsecret"
+	if status := postField(router, "/stream/"+key+"/", secret).Code; status != http.StatusOK {
+		t.Fatalf("Expected claiming post to succeed, got status %d", status)
+	}
+
+	unsigned, _ := http.NewRequest("GET", "/stats/"+key+"/", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, unsigned)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for an unsigned request, got %d", http.StatusUnauthorized, recorder.Code)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signed, _ := http.NewRequest("GET", "/stats/"+key+"/", nil)
+	signed.Header.Set("X-Gweet-Timestamp", timestamp)
+	signed.Header.Set("X-Gweet-Signature", sign(secret, []byte(key+timestamp)))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, signed)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d for a validly signed request, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	topic, ok := response["topic"].(map[string]interface{})
+	if !ok {
+		t.Fatal("topic field is not a map")
+	}
+	if topic["messages_published"] != float64(1) {
+		t.Errorf("Expected messages_published 1, got %v", topic["messages_published"])
+	}
+}
+
+// TestStatsHandlerOmitsClaimedTopics verifies that the aggregate /stats/
+// endpoint, which has no per-topic secret to check a signature against,
+// leaves claimed topics out entirely rather than exposing their activity to
+// anyone who asks.
+func TestStatsHandlerOmitsClaimedTopics(t *testing.T) {
+	initTestEnvironment()
+	router := statsRouter()
+
+	openKey := "stats-test-aggregate-open"
+	claimedKey := "stats-test-aggregate-claimed"
+	secret := "topsecret"
+
+	if status := postField(router, "/stream/"+openKey+"/", "").Code; status != http.StatusOK {
+		t.Fatalf("Expected open post to succeed, got status %d", status)
+	}
+	if status := postField(router, "/stream/"+claimedKey+"/", secret).Code; status != http.StatusOK {
+		t.Fatalf("Expected claiming post to succeed, got status %d", status)
+	}
+
+	req, _ := http.NewRequest("GET", "/stats/", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	topics, ok := response["topics"].([]interface{})
+	if !ok {
+		t.Fatal("topics field is not a list")
+	}
+
+	openCacheKey := hashKey(openKey)
+	claimedCacheKey := secureKey(claimedKey, secret)
+
+	foundOpen := false
+	for _, item := range topics {
+		topic, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if topic["key"] == claimedCacheKey {
+			t.Errorf("Expected the claimed topic's stats to be omitted from the aggregate endpoint, found %v", topic)
+		}
+		if topic["key"] == openCacheKey {
+			foundOpen = true
+		}
+	}
+	if !foundOpen {
+		t.Error("Expected the open topic's stats to be present in the aggregate endpoint")
+	}
+}
@@ -1,50 +1,311 @@
 package main
 
 import (
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BufferLength is how many messages a subscriber's channel holds before its
+// eviction policy decides what happens to the next one. It's set from the
+// -buffer-length flag before the first topic is registered.
+var BufferLength = 256
+
+// EvictionPolicy controls what a Broker does for one subscriber when that
+// subscriber's buffer is full and another message needs to be delivered. A
+// subscriber picks its policy at registration time, via the ?policy= query
+// parameter (see policyFor).
+type EvictionPolicy string
 
-	"github.com/tv42/topic"
+const (
+	// PolicyDropOldest discards the subscriber's oldest buffered message to
+	// make room, and folds the discards into a single {"type":"gap"} event
+	// carrying a since_id the client can resume from. It never blocks the
+	// publisher and is the default.
+	PolicyDropOldest EvictionPolicy = "drop-oldest"
+	// PolicyBlock makes Broker.Publish wait, up to BlockTimeout, for room
+	// to free up in the subscriber's buffer before giving up on it.
+	PolicyBlock EvictionPolicy = "block"
+	// PolicyDisconnect drops the subscriber outright the instant its
+	// buffer is full, the behavior gweet had before per-subscriber
+	// buffering existed.
+	PolicyDisconnect EvictionPolicy = "disconnect"
 )
 
-// The pub/sub topic map struct.
-type TopicMapEntry struct {
-	t     *topic.Topic
-	count uint64
+// BlockTimeout bounds how long Broker.Publish waits for a PolicyBlock
+// subscriber to make room before reporting ErrBufferFull.
+const BlockTimeout = 2 * time.Second
+
+// ErrBufferFull is returned by Broker.Publish when a PolicyBlock
+// subscriber was still full after BlockTimeout, or a PolicyDisconnect
+// subscriber had to be dropped for the same reason.
+var ErrBufferFull = errors.New("subscriber buffer full")
+
+// subscriber is one registered listener on a Broker: a bounded channel of
+// outbound messages plus the eviction policy that decides what happens to
+// it when that channel fills up.
+type subscriber struct {
+	out    chan interface{}
+	policy EvictionPolicy
+
+	// mu serializes every send on out against Unregister's close, and
+	// guards pendingDropped/lastID below, since Broker.Publish can run
+	// concurrently with itself (multiple publishers) as well as with
+	// Unregister.
+	mu     sync.Mutex
+	closed bool
+
+	dropped uint64 // atomic
+
+	// pendingDropped and lastID track PolicyDropOldest's gap reporting.
+	// Only touched while mu is held.
+	pendingDropped uint64
+	lastID         uint64
+}
+
+func newSubscriber(policy EvictionPolicy) *subscriber {
+	return &subscriber{out: make(chan interface{}, BufferLength), policy: policy}
+}
+
+// Dropped returns how many messages this subscriber's buffer has discarded
+// so far under PolicyDropOldest.
+func (s *subscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// deliverDropOldest delivers message using ring-buffer semantics: if out is
+// already full, the oldest buffered message is discarded to make room.
+func (s *subscriber) deliverDropOldest(message interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	if s.pendingDropped > 0 {
+		s.push(map[string]interface{}{
+			"type":     "gap",
+			"dropped":  s.pendingDropped,
+			"since_id": s.lastID,
+		})
+		s.pendingDropped = 0
+	}
+
+	if asserted, ok := message.(map[string]interface{}); ok {
+		s.lastID = messageID(asserted)
+	}
+
+	before := atomic.LoadUint64(&s.dropped)
+	s.push(message)
+	s.pendingDropped += atomic.LoadUint64(&s.dropped) - before
+}
+
+// sendBlocking delivers message to a PolicyBlock subscriber, waiting up to
+// BlockTimeout for room. It reports true if the subscriber was already gone
+// (nothing to do) or the send succeeded, false if the deadline passed first.
+func (s *subscriber) sendBlocking(message interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return true
+	}
+
+	select {
+	case s.out <- message:
+		return true
+	case <-time.After(BlockTimeout):
+		return false
+	}
+}
+
+// sendOrReportFull delivers message to a PolicyDisconnect subscriber without
+// blocking. It reports true if the subscriber was already gone or the send
+// succeeded, false if its buffer was full.
+func (s *subscriber) sendOrReportFull(message interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return true
+	}
+
+	select {
+	case s.out <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// push writes item to out, dropping the oldest buffered message to make
+// room if it's already full.
+func (s *subscriber) push(item interface{}) {
+	for {
+		select {
+		case s.out <- item:
+			return
+		default:
+			select {
+			case <-s.out:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+	}
+}
+
+// Broker owns one topic's live subscribers and fans a published message out
+// to each of them according to its own eviction policy.
+type Broker struct {
+	sync.RWMutex
+	subscribers map[chan<- interface{}]*subscriber
+	count       uint64
+
+	// publishMu serializes this Broker's own deliveries so messages still
+	// reach its subscribers in publish order when Publish is invoked from
+	// more than one goroutine at once (see Cacher in cache.go, which runs
+	// each topic's Publish in its own goroutine precisely so one stalled
+	// PolicyBlock subscriber can't stall every other topic's deliveries).
+	publishMu sync.Mutex
 }
 
+func newBroker() *Broker {
+	return &Broker{subscribers: make(map[chan<- interface{}]*subscriber)}
+}
+
+// Register adds a subscriber with the given eviction policy and returns the
+// channel it should read published messages from.
+func (b *Broker) Register(policy EvictionPolicy) chan interface{} {
+	sub := newSubscriber(policy)
+
+	b.Lock()
+	b.count++
+	b.subscribers[sub.out] = sub
+	b.Unlock()
+
+	return sub.out
+}
+
+// Unregister removes a subscriber and closes its channel so whatever's
+// reading it sees the stream end. It returns how many subscribers remain.
+func (b *Broker) Unregister(ch chan<- interface{}) uint64 {
+	b.Lock()
+	sub, ok := b.subscribers[ch]
+	if ok {
+		delete(b.subscribers, ch)
+		b.count--
+	}
+	remaining := b.count
+	b.Unlock()
+
+	if ok {
+		sub.mu.Lock()
+		sub.closed = true
+		close(sub.out)
+		sub.mu.Unlock()
+	}
+	return remaining
+}
+
+// Publish fans message out to every subscriber per its own eviction
+// policy: PolicyDropOldest never blocks and drops its own oldest buffered
+// message to make room; PolicyBlock waits up to BlockTimeout for room
+// before giving up; PolicyDisconnect drops the subscriber outright. It
+// returns ErrBufferFull if any PolicyBlock or PolicyDisconnect subscriber's
+// buffer was still full, so the publisher can surface real backpressure
+// instead of losing the message silently.
+func (b *Broker) Publish(message interface{}) error {
+	b.RLock()
+	subs := make(map[chan<- interface{}]*subscriber, len(b.subscribers))
+	for ch, sub := range b.subscribers {
+		subs[ch] = sub
+	}
+	b.RUnlock()
+
+	full := false
+	for ch, sub := range subs {
+		switch sub.policy {
+		case PolicyBlock:
+			if !sub.sendBlocking(message) {
+				ERROR.Println("Subscriber buffer still full past the block deadline")
+				full = true
+			}
+		case PolicyDisconnect:
+			if !sub.sendOrReportFull(message) {
+				ERROR.Println("Subscriber buffer full, disconnecting")
+				b.Unregister(ch)
+				full = true
+			}
+		default:
+			sub.deliverDropOldest(message)
+		}
+	}
+
+	if full {
+		return ErrBufferFull
+	}
+	return nil
+}
+
+// Stats returns the live subscriber count and the total number of messages
+// dropped from subscriber buffers.
+func (b *Broker) Stats() (subscribers uint64, dropped uint64) {
+	b.RLock()
+	defer b.RUnlock()
+	for _, sub := range b.subscribers {
+		dropped += sub.Dropped()
+	}
+	return b.count, dropped
+}
+
+// TopicMapStruct maps each topic key to the Broker managing its
+// subscribers. It has its own lock so finding or creating an entry never
+// needs a Broker's own lock, which only guards that Broker's subscribers.
 type TopicMapStruct struct {
 	sync.RWMutex
-	m map[string]TopicMapEntry
+	m map[string]*Broker
 }
 
-func (tms *TopicMapStruct) Register(key string) chan interface{} {
+func (tms *TopicMapStruct) Register(key string, policy EvictionPolicy) chan interface{} {
 	tms.Lock()
-	t, ok := tms.m[key]
+	broker, ok := tms.m[key]
 	if !ok {
-		t = TopicMapEntry{topic.New(), 0}
-		tms.m[key] = t
+		broker = newBroker()
+		tms.m[key] = broker
 	}
-	t.count++
 	tms.Unlock()
 
-	ch := make(chan interface{})
-	t.t.Register(ch)
-	return ch
+	return broker.Register(policy)
 }
 
 func (tms *TopicMapStruct) Unregister(key string, ch chan<- interface{}) {
-	tms.Lock()
-	defer tms.Unlock()
-
-	t, ok := tms.m[key]
+	tms.RLock()
+	broker, ok := tms.m[key]
+	tms.RUnlock()
 	if !ok {
 		return
 	}
-	t.t.Unregister(ch)
-	t.count--
-	if t.count == 0 {
-		delete(tms.m, key)
+
+	if broker.Unregister(ch) == 0 {
+		tms.Lock()
+		if current, ok := tms.m[key]; ok && current == broker {
+			delete(tms.m, key)
+		}
+		tms.Unlock()
+	}
+}
+
+// Stats returns the live subscriber count and the total number of messages
+// dropped from subscriber buffers for a topic key. Both are zero for a key
+// nobody has ever registered on.
+func (tms *TopicMapStruct) Stats(key string) (subscribers uint64, dropped uint64) {
+	tms.RLock()
+	broker, ok := tms.m[key]
+	tms.RUnlock()
+	if !ok {
+		return 0, 0
 	}
+	return broker.Stats()
 }
 
-var TopicMap = TopicMapStruct{m: make(map[string]TopicMapEntry)}
+var TopicMap = TopicMapStruct{m: make(map[string]*Broker)}
@@ -12,7 +12,7 @@ func TestMultipleConcurrentWritersOnSameTopic(t *testing.T) {
 	testKey := "test-topic-concurrent"
 
 	// Reset the TopicMap to ensure clean state.
-	TopicMap = TopicMapStruct{m: make(map[string]*TopicMapEntry)}
+	TopicMap = TopicMapStruct{m: make(map[string]*Broker)}
 
 	// Create multiple writer channels.
 	numWriters := 3
@@ -24,7 +24,7 @@ func TestMultipleConcurrentWritersOnSameTopic(t *testing.T) {
 
 	// Register multiple writers on the same topic.
 	for i := 0; i < numWriters; i++ {
-		writerChannels[i] = TopicMap.Register(testKey)
+		writerChannels[i] = TopicMap.Register(testKey, PolicyDropOldest)
 		t.Logf("Registered writer %d", i)
 	}
 
@@ -95,12 +95,13 @@ func TestMultipleConcurrentWritersOnSameTopic(t *testing.T) {
 	for _, msg := range messages {
 		// Simulate the cache broadcast mechanism.
 		TopicMap.RLock()
-		if currentTopic, ok := TopicMap.m[testKey]; ok {
-			currentTopic.t.Broadcast <- msg
+		broker, ok := TopicMap.m[testKey]
+		TopicMap.RUnlock()
+		if ok {
+			broker.Publish(msg)
 		} else {
 			t.Errorf("Topic %s not found in map when it should exist", testKey)
 		}
-		TopicMap.RUnlock()
 
 		// Small delay between messages.
 		time.Sleep(100 * time.Millisecond)
@@ -132,22 +133,18 @@ func TestConcurrentRegisterUnregister(t *testing.T) {
 			defer wg.Done()
 
 			// Register a channel.
-			ch := TopicMap.Register(testKey)
+			ch := TopicMap.Register(testKey, PolicyDropOldest)
 
 			// Simulate some work.
 			time.Sleep(10 * time.Millisecond)
 
 			// Send a test message.
 			TopicMap.RLock()
-			if currentTopic, ok := TopicMap.m[testKey]; ok {
-				select {
-				case currentTopic.t.Broadcast <- idx:
-					// Message sent successfully.
-				default:
-					// Broadcast channel might be full.
-				}
-			}
+			broker, ok := TopicMap.m[testKey]
 			TopicMap.RUnlock()
+			if ok {
+				broker.Publish(idx)
+			}
 
 			// Unregister the channel.
 			TopicMap.Unregister(testKey, ch)
@@ -172,7 +169,7 @@ func TestTopicCountTracking(t *testing.T) {
 	testKey := "test-topic-count"
 
 	// Register first writer.
-	ch1 := TopicMap.Register(testKey)
+	ch1 := TopicMap.Register(testKey, PolicyDropOldest)
 
 	// Check count should be 1.
 	TopicMap.RLock()
@@ -186,7 +183,7 @@ func TestTopicCountTracking(t *testing.T) {
 	}
 
 	// Register second writer.
-	ch2 := TopicMap.Register(testKey)
+	ch2 := TopicMap.Register(testKey, PolicyDropOldest)
 
 	// Check count should be 2.
 	TopicMap.RLock()
@@ -200,7 +197,7 @@ func TestTopicCountTracking(t *testing.T) {
 	}
 
 	// Register third writer.
-	ch3 := TopicMap.Register(testKey)
+	ch3 := TopicMap.Register(testKey, PolicyDropOldest)
 
 	// Check count should be 3.
 	TopicMap.RLock()
@@ -252,3 +249,79 @@ func TestTopicCountTracking(t *testing.T) {
 		t.Error("Topic should be removed from map after all unregistrations")
 	}
 }
+
+// TestBrokerPolicyBlockReturnsErrBufferFullPastDeadline verifies that a
+// PolicyBlock subscriber who stops reading makes Publish wait up to
+// BlockTimeout and then report ErrBufferFull, rather than blocking forever
+// or silently dropping the message.
+func TestBrokerPolicyBlockReturnsErrBufferFullPastDeadline(t *testing.T) {
+	previous := BufferLength
+	BufferLength = 1
+	defer func() { BufferLength = previous }()
+
+	testKey := "test-topic-policy-block"
+	ch := TopicMap.Register(testKey, PolicyBlock)
+	defer TopicMap.Unregister(testKey, ch)
+
+	TopicMap.RLock()
+	broker := TopicMap.m[testKey]
+	TopicMap.RUnlock()
+
+	// Fills the one-slot buffer; succeeds immediately.
+	if err := broker.Publish("first"); err != nil {
+		t.Fatalf("Expected the first publish to succeed, got: %v", err)
+	}
+
+	start := time.Now()
+	err := broker.Publish("second")
+	elapsed := time.Since(start)
+
+	if err != ErrBufferFull {
+		t.Errorf("Expected ErrBufferFull, got: %v", err)
+	}
+	if elapsed < BlockTimeout {
+		t.Errorf("Expected Publish to wait the full BlockTimeout, only waited %v", elapsed)
+	}
+}
+
+// TestBrokerPolicyDisconnectDropsSlowSubscriber verifies that a
+// PolicyDisconnect subscriber whose buffer is full is dropped immediately,
+// without Publish waiting on it at all.
+func TestBrokerPolicyDisconnectDropsSlowSubscriber(t *testing.T) {
+	previous := BufferLength
+	BufferLength = 1
+	defer func() { BufferLength = previous }()
+
+	testKey := "test-topic-policy-disconnect"
+	ch := TopicMap.Register(testKey, PolicyDisconnect)
+
+	TopicMap.RLock()
+	broker := TopicMap.m[testKey]
+	TopicMap.RUnlock()
+
+	// Fills the one-slot buffer; succeeds immediately.
+	if err := broker.Publish("first"); err != nil {
+		t.Fatalf("Expected the first publish to succeed, got: %v", err)
+	}
+
+	start := time.Now()
+	err := broker.Publish("second")
+	elapsed := time.Since(start)
+
+	if err != ErrBufferFull {
+		t.Errorf("Expected ErrBufferFull, got: %v", err)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Expected PolicyDisconnect to drop the subscriber without waiting, took %v", elapsed)
+	}
+
+	<-ch // Drain the buffered "first" message before checking for closure.
+	if _, ok := <-ch; ok {
+		t.Error("Expected the disconnected subscriber's channel to be closed")
+	}
+
+	remaining, _ := TopicMap.Stats(testKey)
+	if remaining != 0 {
+		t.Errorf("Expected 0 subscribers left after disconnect, got %d", remaining)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = 30 * time.Second
+	wsSendBuffer = 256
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{"gweet.v1"},
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// wsInboundMessage is the shape clients send over the socket to publish a
+// message, mirroring the form values StreamsPostHandler accepts over HTTP.
+type wsInboundMessage struct {
+	Values map[string]interface{} `json:"values"`
+}
+
+// valuesFromJSON converts a decoded JSON values map into url.Values so it
+// can be handed to makeMessage just like a parsed HTTP form.
+func valuesFromJSON(values map[string]interface{}) url.Values {
+	form := url.Values{}
+	for key, value := range values {
+		if items, ok := value.([]interface{}); ok {
+			for _, item := range items {
+				form.Add(key, fmt.Sprint(item))
+			}
+			continue
+		}
+		form.Add(key, fmt.Sprint(value))
+	}
+	return form
+}
+
+// StreamsWebsocketHandler upgrades the connection to a WebSocket and gives
+// the client a single bidirectional channel: inbound frames are posted to
+// the topic exactly like StreamsPostHandler, outbound frames carry the same
+// message shape as StreamsStreamingGetHandler. Slow consumers are
+// disconnected rather than allowed to back-pressure the publisher. It's
+// registered under both /ws/stream/{key}/ and /stream/{key}/ws, which are
+// equivalent entry points to the same transport.
+func StreamsWebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	hashedKey, err := resolveSubscribeKey(r, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// The subscribe handshake above already required a valid signature for
+	// a claimed topic, so this connection has proven it holds the secret.
+	// Use it to sign whatever the client publishes over the socket, the
+	// same way StreamsPostHandler signs an HTTP publish.
+	secret, _ := secretFor(hashKey(key))
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		WARNING.Println("Failed to upgrade websocket: " + err.Error())
+		return
+	}
+	defer conn.Close()
+
+	messageBus := TopicMap.Register(hashedKey, policyFor(r))
+	defer TopicMap.Unregister(hashedKey, messageBus)
+
+	// All writes go through this mutex, since gorilla/websocket forbids
+	// concurrent writes on the same connection.
+	var writeMutex sync.Mutex
+	writeMessage := func(messageType int, data []byte) error {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteMessage(messageType, data)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+
+	done := make(chan struct{})
+
+	// Reader: pump inbound frames to the topic, mirroring StreamsPostHandler.
+	go func() {
+		defer close(done)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var inbound wsInboundMessage
+			if err := json.Unmarshal(data, &inbound); err != nil {
+				WARNING.Println("Failed to parse websocket message: " + err.Error())
+				continue
+			}
+
+			form := valuesFromJSON(inbound.Values)
+			message := makeMessage(key, &form, secret)
+			CacheBus <- CacheMessage{1, message, hashedKey, nil}
+		}
+	}()
+
+	// Forward broadcasts into a bounded send channel, disconnecting the
+	// client instead of blocking the publisher when it can't keep up.
+	send := make(chan interface{}, wsSendBuffer)
+	go func() {
+		defer close(send)
+		for {
+			select {
+			case message, ok := <-messageBus:
+				if !ok {
+					return
+				}
+				select {
+				case send <- message:
+				default:
+					WARNING.Println("Websocket subscriber too slow, disconnecting: " + hashedKey)
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message, ok := <-send:
+			if !ok {
+				return
+			}
+			if err := writeMessage(websocket.TextMessage, []byte(JSONToString(message))); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := writeMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// TestStreamsWebsocketHandler verifies that a client can publish a message
+// over the socket and receive it back on the same connection.
+func TestStreamsWebsocketHandler(t *testing.T) {
+	initTestEnvironment()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/ws/stream/{key}/", StreamsWebsocketHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/stream/ws_test_key/"
+
+	dialer := &websocket.Dialer{Subprotocols: []string{"gweet.v1"}}
+	conn, resp, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial websocket: %v", err)
+	}
+	defer conn.Close()
+
+	if resp.Header.Get("Sec-Websocket-Protocol") != "gweet.v1" {
+		t.Errorf("Expected subprotocol gweet.v1, got %q", resp.Header.Get("Sec-Websocket-Protocol"))
+	}
+
+	payload := `{"values": {"ws_field": "ws_value"}}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(payload)); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read message back: %v", err)
+	}
+
+	var message map[string]interface{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		t.Fatalf("Failed to parse message JSON: %v, data: %s", err, data)
+	}
+
+	if message["name"] != "ws_test_key" {
+		t.Errorf("Expected name 'ws_test_key', got %v", message["name"])
+	}
+
+	values, ok := message["values"].(map[string]interface{})
+	if !ok {
+		t.Fatal("values field is not a map")
+	}
+
+	wsFieldValues, ok := values["ws_field"].([]interface{})
+	if !ok || len(wsFieldValues) == 0 || wsFieldValues[0] != "ws_value" {
+		t.Errorf("Expected ws_field to have value 'ws_value', got %v", values["ws_field"])
+	}
+}
+
+// TestStreamsWebsocketHandlerAltRoute verifies that /stream/{key}/ws reaches
+// the same handler as /ws/stream/{key}/.
+func TestStreamsWebsocketHandlerAltRoute(t *testing.T) {
+	initTestEnvironment()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/stream/{key}/ws", StreamsWebsocketHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/stream/ws_alt_test_key/ws"
+
+	dialer := &websocket.Dialer{Subprotocols: []string{"gweet.v1"}}
+	conn, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial websocket: %v", err)
+	}
+	defer conn.Close()
+
+	payload := `{"values": {"ws_field": "ws_value"}}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(payload)); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read message back: %v", err)
+	}
+
+	var message map[string]interface{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		t.Fatalf("Failed to parse message JSON: %v, data: %s", err, data)
+	}
+
+	if message["name"] != "ws_alt_test_key" {
+		t.Errorf("Expected name 'ws_alt_test_key', got %v", message["name"])
+	}
+}